@@ -0,0 +1,18 @@
+package replaceall
+
+import "github.com/pmezard/go-difflib/difflib"
+
+// unifiedDiff renders the change from old to new as a unified diff with the
+// given number of context lines. The file headers carry git-style a/ and b/
+// prefixes, so the result applies with `git apply` or `patch -p1`; `patch -p0`
+// looks for the prefixed paths and does not find the files.
+func unifiedDiff(path, old, new string, context int) (string, error) {
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(old),
+		B:        difflib.SplitLines(new),
+		FromFile: "a/" + path,
+		ToFile:   "b/" + path,
+		Context:  context,
+	}
+	return difflib.GetUnifiedDiffString(diff)
+}
@@ -0,0 +1,73 @@
+package replaceall
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	old := "one\ntwo\nthree\nfour\nfive\n"
+	new := "one\ntwo\nTHREE\nfour\nfive\n"
+
+	diff, err := unifiedDiff("f.txt", old, new, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantLines := []string{
+		"--- a/f.txt",
+		"+++ b/f.txt",
+		"@@ -2,3 +2,3 @@",
+		" two",
+		"-three",
+		"+THREE",
+		" four",
+	}
+	for _, want := range wantLines {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff missing line %q; got:\n%s", want, diff)
+		}
+	}
+}
+
+func TestUnifiedDiffContextWidens(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\n"
+	new := "a\nb\nc\nX\ne\nf\ng\n"
+
+	diff, err := unifiedDiff("f.txt", old, new, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "@@ -1,7 +1,7 @@") {
+		t.Errorf("want a 3-line-context hunk spanning all 7 lines, got:\n%s", diff)
+	}
+}
+
+func TestEngineDryRunPatchCollectsAllFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt": &fstest.MapFile{Data: []byte("hello a")},
+		"b.txt": &fstest.MapFile{Data: []byte("hello b")},
+	}
+
+	var patch bytes.Buffer
+	engine := &Engine{
+		Replacer:    strings.NewReplacer("hello", "goodbye"),
+		Root:        ".",
+		FS:          fsys,
+		DryRun:      true,
+		DiffContext: 3,
+		Patch:       &patch,
+	}
+	if err := engine.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := patch.String()
+	for _, want := range []string{"a/a.txt", "b/a.txt", "a/b.txt", "b/b.txt", "-hello a", "+goodbye a", "-hello b", "+goodbye b"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("patch missing %q; got:\n%s", want, got)
+		}
+	}
+}
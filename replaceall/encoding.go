@@ -0,0 +1,69 @@
+package replaceall
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Encoding names the text encoding a file's bytes are read and written in.
+type Encoding string
+
+const (
+	// UTF8 reads and writes bytes as-is. It's the default.
+	UTF8 Encoding = "utf8"
+	// Latin1 transcodes ISO-8859-1 bytes to UTF-8 before the replacer runs,
+	// and back to ISO-8859-1 before writing.
+	Latin1 Encoding = "latin1"
+	// Auto uses UTF-8 when a file's bytes are already valid UTF-8, and
+	// falls back to Latin1 otherwise.
+	Auto Encoding = "auto"
+)
+
+// codec decodes b to UTF-8 for the replacer and returns a matching encode
+// function to convert the result back to the original encoding.
+func (e *Engine) codec(b []byte) (decoded string, encode func(string) ([]byte, error), err error) {
+	switch e.Encoding {
+	case "", UTF8:
+		return string(b), utf8Encode, nil
+	case Latin1:
+		return latin1Codec(b)
+	case Auto:
+		if utf8.Valid(b) {
+			return string(b), utf8Encode, nil
+		}
+		return latin1Codec(b)
+	default:
+		return "", nil, fmt.Errorf("unknown encoding %q", e.Encoding)
+	}
+}
+
+func utf8Encode(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+func latin1Codec(b []byte) (string, func(string) ([]byte, error), error) {
+	decoded, err := charmap.ISO8859_1.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding latin1: %w", err)
+	}
+	encode := func(s string) ([]byte, error) {
+		encoded, err := charmap.ISO8859_1.NewEncoder().Bytes([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("encoding latin1: %w", err)
+		}
+		return encoded, nil
+	}
+	return string(decoded), encode, nil
+}
+
+// looksBinary reports whether b's content type, as sniffed by
+// http.DetectContentType, looks like something other than text.
+func looksBinary(b []byte) bool {
+	n := min(len(b), 512)
+	ct := http.DetectContentType(b[:n])
+	return !strings.HasPrefix(ct, "text/")
+}
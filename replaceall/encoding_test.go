@@ -0,0 +1,77 @@
+package replaceall
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestEngineCodec(t *testing.T) {
+	latin1Bytes, err := charmap.ISO8859_1.NewEncoder().Bytes([]byte("café"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidUTF8 := []byte{0x68, 0x65, 0xff, 0x6c, 0x6c, 0x6f} // "he\xffllo"
+
+	cases := []struct {
+		name     string
+		encoding Encoding
+		input    []byte
+		want     string
+		wantErr  bool
+	}{
+		{"utf8 ascii", UTF8, []byte("hello"), "hello", false},
+		{"utf8 valid unicode", UTF8, []byte("café"), "café", false},
+		{"latin1 roundtrip", Latin1, latin1Bytes, "café", false},
+		{"auto on valid utf8", Auto, []byte("café"), "café", false},
+		{"auto on invalid utf8 falls back to latin1", Auto, invalidUTF8, string([]rune{'h', 'e', 0xff, 'l', 'l', 'o'}), false},
+		{"unknown encoding errors", Encoding("bogus"), []byte("hello"), "", true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &Engine{Encoding: tc.encoding}
+			decoded, encode, err := e.codec(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("codec: %v", err)
+			}
+			if decoded != tc.want {
+				t.Errorf("decoded = %q, want %q", decoded, tc.want)
+			}
+			encoded, err := encode(decoded)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if !bytes.Equal(encoded, tc.input) {
+				t.Errorf("round-trip = %v, want %v", encoded, tc.input)
+			}
+		})
+	}
+}
+
+func TestLooksBinary(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"plain text", []byte("the quick brown fox"), false},
+		{"empty file", []byte{}, false},
+		{"contains NUL byte", []byte("hello\x00world"), true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := looksBinary(tc.data); got != tc.want {
+				t.Errorf("looksBinary(%q) = %v, want %v", tc.data, got, tc.want)
+			}
+		})
+	}
+}
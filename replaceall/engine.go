@@ -0,0 +1,265 @@
+package replaceall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Replacer performs the substitution at the heart of a kawatte run.
+// *strings.Replacer satisfies it for literal substitutions; regex-based
+// substitution is the other implementation.
+type Replacer interface {
+	Replace(s string) string
+}
+
+// SelectAction is the outcome of a SelectFilter decision for a path
+// encountered while walking a tree: whether to process it, skip just that
+// file, or skip an entire directory subtree.
+type SelectAction int
+
+const (
+	// Include means the path should be descended into (for a directory) or
+	// processed (for a file).
+	Include SelectAction = iota
+	// SkipFile means a file should be left untouched. It has no effect on
+	// directories.
+	SkipFile
+	// SkipDir means a directory (and everything under it) should not be
+	// walked at all.
+	SkipDir
+)
+
+// Engine is the reusable core of kawatte: given a Replacer and a tree to
+// walk, it finds files that SelectFilter includes and replaces their
+// contents. It has no dependency on flag parsing, so it can be embedded in
+// another Go program, not just run from the CLI. Only DryRun writes to
+// os.Stdout.
+type Engine struct {
+	// Replacer performs the actual substitution on a file's contents.
+	Replacer Replacer
+	// Root is the directory the engine walks. It's also used, together
+	// with the default OnChange, to locate files to rewrite on disk.
+	Root string
+	// FS is the tree to walk. If nil, it defaults to os.DirFS(Root).
+	// Callers that want an in-memory or otherwise virtual tree (for tests,
+	// say, with fstest.MapFS) can set this directly.
+	FS fs.FS
+	// SelectFilter decides whether to include, skip, or descend into each
+	// path encountered during the walk. If nil, every file is included.
+	SelectFilter func(path string, d fs.DirEntry) SelectAction
+	// OnChange is called with a file's old and new contents whenever a
+	// replacement changes it. If nil, it defaults to writing new back to
+	// the file at Root-joined path on disk.
+	OnChange func(path string, old, new []byte) error
+	// DryRun, if true, prints a unified diff of each file that would change
+	// instead of calling OnChange.
+	DryRun bool
+	// DiffContext is the number of context lines around each hunk in a
+	// DryRun diff.
+	DiffContext int
+	// Patch, if set, receives the unified diff for every changed file
+	// during a DryRun, collecting the whole run as one patch.
+	Patch io.Writer
+	// Jobs is the number of files processed concurrently. If less than 1,
+	// it defaults to runtime.GOMAXPROCS(0).
+	Jobs int
+	// Backup, if non-empty, is an extension appended to a copy of each
+	// changed file's previous contents. Only the default OnChange writes
+	// this copy, before it replaces the file; a custom OnChange gets none.
+	Backup string
+	// MaxSize skips any file larger than this many bytes. Zero means no
+	// limit.
+	MaxSize int64
+	// AllowBinary, if false (the default), skips files that look binary
+	// rather than text.
+	AllowBinary bool
+	// Encoding is the text encoding files are read and written in. The
+	// zero value is UTF8.
+	Encoding Encoding
+	// Logger receives diagnostic output. If nil, diagnostics are discarded.
+	Logger *slog.Logger
+
+	// mu serializes DryRun's writes to stdout and Patch across workers.
+	mu sync.Mutex
+}
+
+// Run walks Root and rewrites every file SelectFilter includes whose
+// contents change under Replacer. Files are processed by a pool of Jobs
+// workers, so OnChange (and any DryRun diffing) for different files can run
+// concurrently; the walk itself stays single-threaded.
+func (e *Engine) Run() error {
+	fsys := e.FS
+	if fsys == nil {
+		fsys = os.DirFS(e.Root)
+	}
+	logger := e.Logger
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	selectFilter := e.SelectFilter
+	if selectFilter == nil {
+		selectFilter = func(string, fs.DirEntry) SelectAction { return Include }
+	}
+	jobs := e.Jobs
+	if jobs < 1 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+
+	paths := make(chan string)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	wg.Add(jobs)
+	for i := 0; i < jobs; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				if err := e.processFile(fsys, path, logger); err != nil {
+					errOnce.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+
+	walkErr := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			logger.Warn("walking directories", "path", path, "error", err)
+			return nil
+		}
+		if path == "." {
+			return nil
+		}
+		switch selectFilter(path, d) {
+		case SkipDir:
+			logger.Debug("skip dir", "path", path)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		case SkipFile:
+			logger.Debug("skip file", "path", path)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		paths <- path
+		return nil
+	})
+	close(paths)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return walkErr
+}
+
+func (e *Engine) processFile(fsys fs.FS, path string, logger *slog.Logger) error {
+	full := filepath.Join(e.Root, path)
+
+	old, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return fmt.Errorf("processFile(%q): reading: %w", full, err)
+	}
+
+	if e.MaxSize > 0 && int64(len(old)) > e.MaxSize {
+		logger.Debug("skip: too large", "path", full, "size", len(old))
+		return nil
+	}
+	if !e.AllowBinary && looksBinary(old) {
+		logger.Debug("skip: binary", "path", full)
+		return nil
+	}
+
+	decoded, encode, err := e.codec(old)
+	if err != nil {
+		return fmt.Errorf("processFile(%q): %w", full, err)
+	}
+
+	newContent, err := encode(e.Replacer.Replace(decoded))
+	if err != nil {
+		return fmt.Errorf("processFile(%q): %w", full, err)
+	}
+	if bytes.Equal(old, newContent) {
+		return nil
+	}
+
+	if e.DryRun {
+		diff, err := unifiedDiff(full, string(old), string(newContent), e.DiffContext)
+		if err != nil {
+			return fmt.Errorf("processFile(%q): diffing: %w", full, err)
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		fmt.Print(diff)
+		if e.Patch != nil {
+			if _, err := io.WriteString(e.Patch, diff); err != nil {
+				return fmt.Errorf("processFile(%q): writing patch: %w", full, err)
+			}
+		}
+		return nil
+	}
+
+	logger.Debug("rewriting", "path", full)
+	onChange := e.OnChange
+	if onChange == nil {
+		onChange = e.writeFile
+	}
+	if err := onChange(full, old, newContent); err != nil {
+		return fmt.Errorf("processFile(%q): %w", full, err)
+	}
+	return nil
+}
+
+// writeFile is the default OnChange: it replaces path with new atomically,
+// by writing to a temp file alongside it and renaming over the original, so
+// a crash mid-write can't corrupt the source. The original file's mode is
+// preserved, and if Backup is set, old is kept alongside path first.
+func (e *Engine) writeFile(path string, old, new []byte) error {
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+
+	if e.Backup != "" {
+		if err := os.WriteFile(path+e.Backup, old, mode); err != nil {
+			return fmt.Errorf("writing backup: %w", err)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".kawatte-*")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once the rename below succeeds
+
+	if _, err := tmp.Write(new); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("syncing temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		return fmt.Errorf("setting mode: %w", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("renaming temp file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package replaceall
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// runFilter runs an Engine over fsys using app's SelectFilter and returns the
+// new contents of every file OnChange was called for, keyed by path.
+func runFilter(t *testing.T, app *appEnv, fsys fstest.MapFS) map[string]string {
+	t.Helper()
+
+	selectFilter, err := app.buildSelectFilter(fsys)
+	if err != nil {
+		t.Fatalf("buildSelectFilter: %v", err)
+	}
+
+	var mu sync.Mutex
+	changed := map[string]string{}
+	engine := &Engine{
+		Replacer:     strings.NewReplacer("hello", "goodbye"),
+		Root:         ".",
+		FS:           fsys,
+		SelectFilter: selectFilter,
+		Logger:       testLogger(),
+		OnChange: func(path string, _, new []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			changed[path] = string(new)
+			return nil
+		},
+	}
+	if err := engine.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return changed
+}
+
+func TestBuildSelectFilterGlobs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":           &fstest.MapFile{Data: []byte("hello")},
+		"skip.log":        &fstest.MapFile{Data: []byte("hello")},
+		"vendor/file.txt": &fstest.MapFile{Data: []byte("hello")},
+		"sub/b.txt":       &fstest.MapFile{Data: []byte("hello")},
+	}
+
+	app := &appEnv{
+		incFile: []string{"*.txt"},
+		exFile:  []string{"*.log"},
+		incDir:  []string{"*"},
+		exDir:   []string{"vendor"},
+		logger:  testLogger(),
+	}
+
+	got := runFilter(t, app, fsys)
+	want := map[string]string{
+		"a.txt":     "goodbye",
+		"sub/b.txt": "goodbye",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changed files = %v, want %v", got, want)
+	}
+}
+
+// TestEngineRunConcurrentWrites exercises the default OnChange (writeFile)
+// over a real directory with Jobs > 1, checking that every file ends up with
+// its new contents, its original mode preserved, and (with Backup set) a
+// sibling backup file holding the old contents.
+func TestEngineRunConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if err := os.WriteFile(name, []byte("hello world"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// One file with a distinctive mode, to confirm writeFile preserves it
+	// rather than always falling back to 0644.
+	executable := filepath.Join(dir, "exec.txt")
+	if err := os.WriteFile(executable, []byte("hello world"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := &Engine{
+		Replacer: strings.NewReplacer("hello", "goodbye"),
+		Root:     dir,
+		Jobs:     4,
+		Backup:   ".bak",
+	}
+	if err := engine.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if string(got) != "goodbye world" {
+			t.Errorf("%s content = %q, want %q", name, got, "goodbye world")
+		}
+		backup, err := os.ReadFile(name + ".bak")
+		if err != nil {
+			t.Fatalf("reading backup for %s: %v", name, err)
+		}
+		if string(backup) != "hello world" {
+			t.Errorf("%s backup content = %q, want %q", name, backup, "hello world")
+		}
+	}
+
+	info, err := os.Stat(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o755 {
+		t.Errorf("exec.txt mode = %v, want %v", info.Mode().Perm(), os.FileMode(0o755))
+	}
+	got, err := os.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "goodbye world" {
+		t.Errorf("exec.txt content = %q, want %q", got, "goodbye world")
+	}
+}
+
+func TestBuildSelectFilterGitignore(t *testing.T) {
+	fsys := fstest.MapFS{
+		".gitignore":      &fstest.MapFile{Data: []byte("vendor/\n")},
+		"a.txt":           &fstest.MapFile{Data: []byte("hello")},
+		"vendor/file.txt": &fstest.MapFile{Data: []byte("hello")},
+	}
+
+	app := &appEnv{
+		incFile:   []string{"*"},
+		exFile:    []string{".*"},
+		incDir:    []string{"*"},
+		exDir:     []string{".*"},
+		gitignore: true,
+		logger:    testLogger(),
+	}
+
+	got := runFilter(t, app, fsys)
+	want := map[string]string{"a.txt": "goodbye"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changed files = %v, want %v (root .gitignore should exclude vendor/)", got, want)
+	}
+}
@@ -4,16 +4,18 @@ import (
 	"encoding/csv"
 	"flag"
 	"fmt"
-	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
-	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
 	"strings"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/carlmjohnson/flagx"
 	"github.com/carlmjohnson/versioninfo"
+	"github.com/shibumi/go-pathspec"
 )
 
 const AppName = "Kawatte"
@@ -25,7 +27,7 @@ func CLI(args []string) error {
 		return err
 	}
 	if err = app.Exec(); err != nil {
-		app.errorLevel.Println(err)
+		app.logger.Error(err.Error())
 	}
 	return err
 }
@@ -38,9 +40,17 @@ type appEnv struct {
 	incDir     []string
 	exDir      []string
 	dryRun     bool
-	infoLevel  *log.Logger
-	warnLevel  *log.Logger
-	errorLevel *log.Logger
+	gitignore  bool
+	ignoreFile string
+	regex      bool
+	patchFile  string
+	context    int
+	jobs       int
+	backup     string
+	maxSize    int64
+	binary     bool
+	encoding   string
+	logger     *slog.Logger
 }
 
 func (app *appEnv) ParseArgs(args []string) error {
@@ -49,29 +59,37 @@ func (app *appEnv) ParseArgs(args []string) error {
 	fl.StringVar(&app.patFile, "pat", "", "path to the CSV `file` containing substitution patterns")
 	fl.StringVar(&app.dir, "dir", ".", "path to the starting `directory`")
 	fl.BoolVar(&app.dryRun, "dry-run", false, "just print the names of files that would be modified")
-
-	fl.Func("match", "`glob` matching files to include (default *)", func(glob string) error {
+	fl.BoolVar(&app.gitignore, "gitignore", false, "skip files and directories excluded by any .gitignore files encountered during the walk")
+	fl.StringVar(&app.ignoreFile, "ignore-file", "", "path to a custom ignore `file` (gitignore syntax) applied in addition to any .gitignore files")
+	fl.BoolVar(&app.regex, "regex", false, "interpret the substitution CSV's two columns as regex,replacement pairs (regexp.ReplaceAllString syntax, supports $1 and ${name}) instead of literal old,new")
+	fl.StringVar(&app.patchFile, "patch", "", "write the dry-run's unified diffs to `file` as a single patch (implies -dry-run)")
+	fl.IntVar(&app.context, "U", 3, "number of context `lines` in dry-run diffs")
+	fl.IntVar(&app.jobs, "jobs", runtime.GOMAXPROCS(0), "number of files to process concurrently")
+	fl.StringVar(&app.backup, "backup", "", "keep a copy of each changed file, named with `.ext` appended, before overwriting it")
+	fl.Int64Var(&app.maxSize, "max-size", 0, "skip files larger than `bytes` (default: no limit)")
+	fl.BoolVar(&app.binary, "binary", false, "also process files that look binary (by default they're skipped)")
+	fl.StringVar(&app.encoding, "encoding", string(UTF8), "text `encoding` of files: utf8, latin1, or auto")
+
+	fl.Func("match", "doublestar `glob` matching files to include (default *)", func(glob string) error {
 		app.incFile = append(app.incFile, glob)
 		return nil
 	})
-	fl.Func("exclude", "`glob` matching files to exclude (default .*)", func(glob string) error {
-		app.incFile = append(app.exFile, glob)
+	fl.Func("exclude", "doublestar `glob` matching files to exclude (default .*)", func(glob string) error {
+		app.exFile = append(app.exFile, glob)
 		return nil
 	})
-	fl.Func("match-dir", "`glob` matching directories to include (default *)", func(glob string) error {
-		app.incFile = append(app.incFile, glob)
+	fl.Func("match-dir", "doublestar `glob` matching directories to include (default *)", func(glob string) error {
+		app.incDir = append(app.incDir, glob)
 		return nil
 	})
-	fl.Func("exclude-dir", "`glob` matching directories to exclude (default .*)", func(glob string) error {
-		app.incFile = append(app.exFile, glob)
+	fl.Func("exclude-dir", "doublestar `glob` matching directories to exclude (default .*)", func(glob string) error {
+		app.exDir = append(app.exDir, glob)
 		return nil
 	})
 
-	app.warnLevel = log.New(os.Stderr, AppName+" [WARNING] ", log.LstdFlags|log.Lmsgprefix)
-	app.errorLevel = log.New(os.Stderr, AppName+" [ERROR] ", log.LstdFlags|log.Lmsgprefix)
-	app.infoLevel = log.New(io.Discard, AppName+" [INFO] ", log.LstdFlags|log.Lmsgprefix)
+	logLevel := slog.LevelWarn
 	flagx.BoolFunc(fl, "verbose", "log debug output", func() error {
-		app.infoLevel.SetOutput(os.Stderr)
+		logLevel = slog.LevelDebug
 		return nil
 	})
 	fl.Usage = func() {
@@ -114,6 +132,12 @@ Options:
 		return err
 	}
 
+	app.logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+	if app.patchFile != "" {
+		app.dryRun = true
+	}
+
 	if len(app.incFile) == 0 {
 		app.incFile = []string{"*"}
 	}
@@ -126,25 +150,62 @@ Options:
 	if len(app.exDir) == 0 {
 		app.exDir = []string{".*"}
 	}
+
+	switch Encoding(app.encoding) {
+	case UTF8, Latin1, Auto:
+	default:
+		return fmt.Errorf("unknown -encoding %q: want utf8, latin1, or auto", app.encoding)
+	}
 	return nil
 }
 
-func (app *appEnv) Exec() (err error) {
+// Exec builds an Engine from the parsed flags and runs it. This is the seam
+// between the CLI's flag-based configuration and the reusable Engine: a
+// caller embedding kawatte as a library builds an Engine directly instead.
+func (app *appEnv) Exec() error {
 	replacer, err := app.loadSubstitutions()
 	if err != nil {
 		return err
 	}
 
-	paths := app.walkDir()
-	for _, path := range paths {
-		if err := app.processFile(path, replacer); err != nil {
-			return err
+	fsys := os.DirFS(app.dir)
+	selectFilter, err := app.buildSelectFilter(fsys)
+	if err != nil {
+		return err
+	}
+
+	engine := &Engine{
+		Replacer:     replacer,
+		Root:         app.dir,
+		FS:           fsys,
+		SelectFilter: selectFilter,
+		DryRun:       app.dryRun,
+		DiffContext:  app.context,
+		Jobs:         app.jobs,
+		Backup:       app.backup,
+		MaxSize:      app.maxSize,
+		AllowBinary:  app.binary,
+		Encoding:     Encoding(app.encoding),
+		Logger:       app.logger,
+	}
+
+	if app.patchFile != "" {
+		patch, err := os.Create(app.patchFile)
+		if err != nil {
+			return fmt.Errorf("creating patch file: %w", err)
 		}
+		defer patch.Close()
+		engine.Patch = patch
 	}
-	return nil
+
+	return engine.Run()
 }
 
-func (app *appEnv) loadSubstitutions() (*strings.Replacer, error) {
+// loadSubstitutions reads the substitution patterns CSV. Each row is either
+// two columns (old,new for literal mode, or pattern,replacement when -regex
+// is set) or three columns (kind,pattern,replacement with kind one of
+// "literal" or "regex"), letting a single file mix both styles.
+func (app *appEnv) loadSubstitutions() (Replacer, error) {
 	file, err := os.Open(app.patFile)
 	if err != nil {
 		return nil, fmt.Errorf("opening substitution patterns file: %w", err)
@@ -152,93 +213,214 @@ func (app *appEnv) loadSubstitutions() (*strings.Replacer, error) {
 	defer file.Close()
 
 	reader := csv.NewReader(file)
-	reader.FieldsPerRecord = 2
+	reader.FieldsPerRecord = -1
 	records, err := reader.ReadAll()
 	if err != nil {
 		return nil, fmt.Errorf("reading substitution patterns file %q: %w", app.patFile, err)
 	}
 
 	if len(records) == 0 {
-		app.warnLevel.Print("found no substitutions")
-	} else {
-		app.infoLevel.Printf("found %d substitutions", len(records))
+		app.logger.Warn("found no substitutions")
+		return strings.NewReplacer(), nil
 	}
+	app.logger.Debug("found substitutions", "count", len(records))
+
+	var literalPairs []string
+	var regexSubs []regexSub
+	hasRegex := false
+	for i, record := range records {
+		kind, pattern, replacement := "literal", "", ""
+		switch len(record) {
+		case 2:
+			pattern, replacement = record[0], record[1]
+			if app.regex {
+				kind = "regex"
+			}
+		case 3:
+			kind, pattern, replacement = record[0], record[1], record[2]
+		default:
+			return nil, fmt.Errorf("substitution patterns file %q: line %d: want 2 or 3 columns, got %d", app.patFile, i+1, len(record))
+		}
 
-	replacements := slices.Grow[[]string](nil, len(records)*2)
-	for _, record := range records {
-		replacements = append(replacements, record[0], record[1])
+		switch kind {
+		case "literal":
+			literalPairs = append(literalPairs, pattern, replacement)
+			// Escape "$" so a literal replacement isn't expanded as a template.
+			regexSubs = append(regexSubs, regexSub{re: regexp.MustCompile(regexp.QuoteMeta(pattern)), replacement: strings.ReplaceAll(replacement, "$", "$$")})
+		case "regex":
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("substitution patterns file %q: line %d: compiling regex %q: %w", app.patFile, i+1, pattern, err)
+			}
+			regexSubs = append(regexSubs, regexSub{re: re, replacement: replacement})
+			hasRegex = true
+		default:
+			return nil, fmt.Errorf("substitution patterns file %q: line %d: unknown kind %q, want \"literal\" or \"regex\"", app.patFile, i+1, kind)
+		}
 	}
 
-	return strings.NewReplacer(replacements...), nil
+	// The common case, a plain two-column literal CSV, keeps using
+	// strings.Replacer: it's faster and its all-at-once semantics (no
+	// substitution can be re-matched by a later one) are what users expect.
+	// Regex patterns, or a 3-column file mixing kinds, need row order
+	// preserved, so they fall through to the slower regexReplacer.
+	if !hasRegex {
+		return strings.NewReplacer(literalPairs...), nil
+	}
+	return &regexReplacer{subs: regexSubs}, nil
 }
 
-func (app *appEnv) walkDir() []string {
-	var paths []string
-	_ = filepath.WalkDir(app.dir, func(path string, entry fs.DirEntry, err error) error {
-		if err != nil {
-			app.warnLevel.Printf("walking directories: %v", err)
-			return nil
-		}
-		if entry.IsDir() {
-			if path == "." {
-				return nil
-			}
-			for _, glob := range app.exDir {
-				if matched, _ := filepath.Match(glob, entry.Name()); matched {
-					app.infoLevel.Printf("exclude dir %q", path)
-					return filepath.SkipDir
-				}
-			}
+// ignoreFrame tracks the gitignore patterns in effect for a directory and its
+// descendants, so a .gitignore found deeper in the tree only affects the
+// subtree it lives in.
+type ignoreFrame struct {
+	dir      string
+	patterns []string
+}
 
-			for _, glob := range app.incDir {
-				if matched, _ := filepath.Match(glob, entry.Name()); matched {
-					app.infoLevel.Printf("match for dir %q", path)
-					return nil
-				}
-			}
-			app.infoLevel.Printf("no match for dir %q", path)
-			return filepath.SkipDir
-		}
-		for _, glob := range app.exFile {
-			if matched, _ := filepath.Match(glob, entry.Name()); matched {
-				app.infoLevel.Printf("exclude for %q", path)
-				return nil
-			}
+// parseGitIgnoreLines splits gitignore-syntax content into patterns,
+// skipping blank lines and comments.
+func parseGitIgnoreLines(data []byte) []string {
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
 
-		for _, glob := range app.incFile {
-			if matched, _ := filepath.Match(glob, entry.Name()); matched {
-				app.infoLevel.Printf("match for %q", path)
-				paths = append(paths, path)
-				return nil
-			}
-		}
-		app.infoLevel.Printf("no match for %q", path)
-		return nil
-	})
-	return paths
+// readGitIgnorePatterns loads the gitignore-syntax lines in an OS file. It
+// backs -ignore-file, which names a file that need not live inside the tree
+// being walked.
+func readGitIgnorePatterns(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseGitIgnoreLines(data), nil
 }
 
-func (app *appEnv) processFile(filePath string, replacer *strings.Replacer) error {
-	b, err := os.ReadFile(filePath)
+// readGitIgnorePatternsFS loads the gitignore-syntax lines from path inside
+// fsys. It backs the .gitignore files discovered while walking the tree, so
+// that discovery works the same way against a real disk or an fstest.MapFS.
+func readGitIgnorePatternsFS(fsys fs.FS, path string) ([]string, error) {
+	data, err := fs.ReadFile(fsys, path)
 	if err != nil {
-		return fmt.Errorf("processFile(%q): reading: %w", filePath, err)
+		return nil, err
 	}
+	return parseGitIgnoreLines(data), nil
+}
+
+// ignored reports whether path is excluded by any of the given
+// gitignore-syntax patterns.
+func ignored(logger *slog.Logger, patterns []string, path string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	ignore, err := pathspec.GitIgnore(patterns, path)
+	if err != nil {
+		logger.Warn("evaluating gitignore patterns", "path", path, "error", err)
+		return false
+	}
+	return ignore
+}
 
-	oldContent := string(b)
-	newContent := replacer.Replace(oldContent)
+// globMatch matches glob against name, or, if glob contains a slash, against
+// relPath instead. A slash-free pattern like "*.go" matches the basename
+// anywhere, while a pattern like "src/**/*.go" is matched against the full
+// path relative to the walk root and can cross directory boundaries via "**".
+func globMatch(glob, name, relPath string) (bool, error) {
+	if strings.Contains(glob, "/") {
+		return doublestar.Match(glob, relPath)
+	}
+	return doublestar.Match(glob, name)
+}
 
-	if app.dryRun {
-		if oldContent != newContent {
-			fmt.Printf("* %q\n", filePath)
+func matchAny(globs []string, name, relPath string) bool {
+	for _, glob := range globs {
+		if matched, _ := globMatch(glob, name, relPath); matched {
+			return true
 		}
-		return nil
 	}
+	return false
+}
 
-	err = os.WriteFile(filePath, []byte(newContent), 0o644)
-	if err != nil {
-		return fmt.Errorf("processFile(%q): writing: %w", filePath, err)
+func withinDir(dir, path string) bool {
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// joinFS joins a directory encountered during an fs.FS walk with a file
+// name, staying within fs.FS's slash-separated, dot-rooted path rules.
+func joinFS(dir, name string) string {
+	if dir == "." {
+		return name
 	}
+	return dir + "/" + name
+}
 
-	return nil
+// buildSelectFilter turns the CLI's four glob flags, plus -gitignore and
+// -ignore-file, into a single SelectFilter predicate for an Engine. The
+// Engine itself knows nothing about globs or gitignore syntax; it only sees
+// the tri-state result.
+//
+// -ignore-file's patterns apply regardless of -gitignore. -gitignore only
+// controls whether .gitignore files are additionally discovered and read
+// while walking, starting with one at the root of -dir (which, unlike every
+// other directory, is never passed to the returned SelectFilter, since
+// Engine.Run skips calling it for the walk root).
+func (app *appEnv) buildSelectFilter(fsys fs.FS) (func(string, fs.DirEntry) SelectAction, error) {
+	var base []string
+	if app.ignoreFile != "" {
+		patterns, err := readGitIgnorePatterns(app.ignoreFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ignore file %q: %w", app.ignoreFile, err)
+		}
+		base = patterns
+	}
+	if app.gitignore {
+		if gi, err := readGitIgnorePatternsFS(fsys, ".gitignore"); err == nil {
+			base = append(slices.Clone(base), gi...)
+		}
+	}
+	stack := []ignoreFrame{{dir: ".", patterns: base}}
+
+	return func(path string, d fs.DirEntry) SelectAction {
+		for len(stack) > 1 && !withinDir(stack[len(stack)-1].dir, path) {
+			stack = stack[:len(stack)-1]
+		}
+		active := stack[len(stack)-1].patterns
+
+		if d.IsDir() {
+			if app.gitignore {
+				if gi, err := readGitIgnorePatternsFS(fsys, joinFS(path, ".gitignore")); err == nil {
+					active = append(slices.Clone(active), gi...)
+				}
+			}
+			stack = append(stack, ignoreFrame{dir: path, patterns: active})
+			if ignored(app.logger, active, path) {
+				return SkipDir
+			}
+			if matchAny(app.exDir, d.Name(), path) {
+				return SkipDir
+			}
+			if matchAny(app.incDir, d.Name(), path) {
+				return Include
+			}
+			return SkipDir
+		}
+
+		if ignored(app.logger, active, path) {
+			return SkipFile
+		}
+		if matchAny(app.exFile, d.Name(), path) {
+			return SkipFile
+		}
+		if matchAny(app.incFile, d.Name(), path) {
+			return Include
+		}
+		return SkipFile
+	}, nil
 }
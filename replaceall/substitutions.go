@@ -0,0 +1,21 @@
+package replaceall
+
+import "regexp"
+
+// regexReplacer applies an ordered list of compiled regexes, each with its
+// own replacement (which may reference capture groups via $1 or ${name}).
+type regexReplacer struct {
+	subs []regexSub
+}
+
+type regexSub struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (r *regexReplacer) Replace(s string) string {
+	for _, sub := range r.subs {
+		s = sub.re.ReplaceAllString(s, sub.replacement)
+	}
+	return s
+}
@@ -0,0 +1,87 @@
+package replaceall
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSubstitutionsLiteral(t *testing.T) {
+	app := &appEnv{patFile: writeCSV(t, "a,b\nb,c\n"), logger: testLogger()}
+	replacer, err := app.loadSubstitutions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := replacer.Replace("abc"), "bcc"; got != want {
+		t.Errorf("Replace(%q) = %q, want %q", "abc", got, want)
+	}
+}
+
+func TestLoadSubstitutionsRegex(t *testing.T) {
+	app := &appEnv{
+		patFile: writeCSV(t, `(\w+)@(\w+)\.com,${2}@${1}.com`+"\n"),
+		regex:   true,
+		logger:  testLogger(),
+	}
+	replacer, err := app.loadSubstitutions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := replacer.Replace("user@example.com")
+	want := "example@user.com"
+	if got != want {
+		t.Errorf("Replace = %q, want %q", got, want)
+	}
+}
+
+func TestLoadSubstitutionsRegexCaptureGroupNumber(t *testing.T) {
+	app := &appEnv{
+		patFile: writeCSV(t, `(\w+) (\w+),$2 $1`+"\n"),
+		regex:   true,
+		logger:  testLogger(),
+	}
+	replacer, err := app.loadSubstitutions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := replacer.Replace("Jane Doe")
+	want := "Doe Jane"
+	if got != want {
+		t.Errorf("Replace = %q, want %q", got, want)
+	}
+}
+
+func TestLoadSubstitutionsMixedThreeColumn(t *testing.T) {
+	app := &appEnv{
+		patFile: writeCSV(t, "literal,foo,bar\nregex,(\\d+),N\n"),
+		logger:  testLogger(),
+	}
+	replacer, err := app.loadSubstitutions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := replacer.Replace("foo123")
+	want := "barN"
+	if got != want {
+		t.Errorf("Replace = %q, want %q", got, want)
+	}
+}
+
+func TestLoadSubstitutionsUnknownKind(t *testing.T) {
+	app := &appEnv{
+		patFile: writeCSV(t, "bogus,a,b\n"),
+		logger:  testLogger(),
+	}
+	if _, err := app.loadSubstitutions(); err == nil {
+		t.Fatal("want error for unknown kind, got nil")
+	}
+}
+
+func writeCSV(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "subs.csv")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}